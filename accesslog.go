@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+)
+
+// accessLogEntry is a single structured (JSON) access log line.
+type accessLogEntry struct {
+	RequestID string  `json:"request_id"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Status    int     `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Principal string  `json:"principal"`
+}
+
+func logAccess(entry accessLogEntry) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("error marshaling access log entry: %v\n", err)
+		return
+	}
+
+	log.Println(string(b))
+}
+
+// newRequestID returns a short random hex identifier for correlating an access log entry with
+// the request that produced it.
+func newRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(b[:])
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -11,16 +13,19 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/client/metadata"
 	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/defaults"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"golang.org/x/net/http2"
 )
 
 var targetFlag = flag.String("target", os.Getenv("AWS_ES_TARGET"), "target url to proxy to")
@@ -31,93 +36,181 @@ var flushInterval = flag.Int("flush-interval", 0, "Flush interval to flush to th
 var idleConnTimeout = flag.Int("idle-conn-timeout", 90, "the maximum amount of time an idle (keep-alive) connection will remain idle before closing itself. Zero means no limit.")
 var dialTimeout = flag.Int("dial-timeout", 30, "The maximum amount of time a dial will wait for a connect to complete.")
 var dialKeepAlive = flag.Int("dial-keep-alive", 30, "The amount of time a dial will keep a connection alive for.")
+var serviceFlag = flag.String("service", "es", "AWS service name to sign for (e.g. es, s3, dynamodb, lambda)")
+var signingNameFlag = flag.String("signing-name", "", "Override the signing name used in the SigV4 credential scope. Defaults to --service.")
+var signingRegionFlag = flag.String("signing-region", "", "Override the signing region used in the SigV4 credential scope. Defaults to --region.")
+var presignFlag = flag.Bool("presign", false, "Instead of signing and forwarding requests, respond with a 307 redirect to a presigned URL")
+var presignTTLFlag = flag.Duration("presign-ttl", 5*time.Minute, "Expiry duration for presigned URLs when --presign is set")
+var maxRetriesFlag = flag.Int("max-retries", 3, "Maximum number of retries for idempotent requests that fail with a transport error or a 5xx/429 upstream response")
+var tlsCertFlag = flag.String("tls-cert", "", "Path to a PEM certificate to serve TLS with. Requires --tls-key.")
+var tlsKeyFlag = flag.String("tls-key", "", "Path to the PEM private key for --tls-cert.")
+var tlsClientCAFlag = flag.String("tls-client-ca", "", "Path to a PEM CA bundle used to verify client certificates (mTLS). Requires --tls-cert/--tls-key.")
+var tlsMinVersionFlag = flag.String("tls-min-version", "1.2", "Minimum TLS version to accept on the listener: 1.0, 1.1, 1.2, or 1.3.")
+var insecureSkipVerifyFlag = flag.Bool("insecure-skip-verify", false, "Disable TLS certificate verification for the upstream target. Insecure, for testing only.")
+var upstreamCAFlag = flag.String("upstream-ca", "", "Path to a PEM CA bundle used to verify the upstream target's certificate, e.g. for a VPC endpoint with a private CA.")
+var readHeaderTimeoutFlag = flag.Duration("read-header-timeout", 10*time.Second, "The amount of time allowed to read request headers.")
+var readTimeoutFlag = flag.Duration("read-timeout", 0, "The maximum duration for reading the entire request, including the body. Zero means no limit.")
+var writeTimeoutFlag = flag.Duration("write-timeout", 0, "The maximum duration before timing out writes of the response. Zero means no limit.")
+var serverIdleTimeoutFlag = flag.Duration("idle-timeout", 360*time.Second, "The maximum amount of time to wait for the next request on a keep-alive connection.")
+var shutdownGraceFlag = flag.Duration("shutdown-grace", 30*time.Second, "How long to wait for in-flight requests to complete when shutting down.")
+var metricsAddrFlag = flag.String("metrics-addr", "", "If set, serve Prometheus metrics on this address (e.g. :9100), on a separate listener that doesn't require SigV4.")
+var credentialsProviderFlag = flag.String("credentials-provider", "default", "AWS credentials provider to use: default, env, shared, ec2, ecs, web-identity, or assume-role.")
+var assumeRoleARNFlag = flag.String("assume-role-arn", "", "Role ARN to assume when --credentials-provider=assume-role.")
+var assumeRoleSessionNameFlag = flag.String("assume-role-session-name", "aws-signing-proxy", "Session name to use when assuming a role (--credentials-provider=assume-role or web-identity).")
+var assumeRoleExternalIDFlag = flag.String("assume-role-external-id", "", "External ID to use when --credentials-provider=assume-role.")
+var assumeRoleDurationFlag = flag.Duration("assume-role-duration", 0, "Duration of the assumed role's credentials. Zero uses the AWS SDK default (15m).")
+var webIdentityTokenFileFlag = flag.String("web-identity-token-file", "", "Path to the web identity (OIDC) token file when --credentials-provider=web-identity.")
+var webIdentityRoleARNFlag = flag.String("web-identity-role-arn", "", "Role ARN to assume when --credentials-provider=web-identity.")
 
 type configuration struct {
-	Target          string `mapstructure:"target"`
-	Port            int    `mapstructure:"port"`
-	ListenAddress   string `mapstructure:"listen-address"`
-	Region          string `mapstructure:"region"`
-	FlushInterval   int    `mapstructure:"flush-interval"`
-	IdleConnTimeout int    `mapstructure:"idle-conn-timeout"`
-	DialTimeout     int    `mapstructure:"dial-timeout"`
-	DialKeepAlive   int    `mapstructure:"dial-keep-alive"`
+	Target                string        `mapstructure:"target"`
+	Port                  int           `mapstructure:"port"`
+	ListenAddress         string        `mapstructure:"listen-address"`
+	Region                string        `mapstructure:"region"`
+	FlushInterval         int           `mapstructure:"flush-interval"`
+	IdleConnTimeout       int           `mapstructure:"idle-conn-timeout"`
+	DialTimeout           int           `mapstructure:"dial-timeout"`
+	DialKeepAlive         int           `mapstructure:"dial-keep-alive"`
+	Service               string        `mapstructure:"service"`
+	SigningName           string        `mapstructure:"signing-name"`
+	SigningRegion         string        `mapstructure:"signing-region"`
+	Presign               bool          `mapstructure:"presign"`
+	PresignTTL            time.Duration `mapstructure:"presign-ttl"`
+	MaxRetries            int           `mapstructure:"max-retries"`
+	TLSCert               string        `mapstructure:"tls-cert"`
+	TLSKey                string        `mapstructure:"tls-key"`
+	TLSClientCA           string        `mapstructure:"tls-client-ca"`
+	TLSMinVersion         string        `mapstructure:"tls-min-version"`
+	InsecureSkipVerify    bool          `mapstructure:"insecure-skip-verify"`
+	UpstreamCA            string        `mapstructure:"upstream-ca"`
+	ReadHeaderTimeout     time.Duration `mapstructure:"read-header-timeout"`
+	ReadTimeout           time.Duration `mapstructure:"read-timeout"`
+	WriteTimeout          time.Duration `mapstructure:"write-timeout"`
+	IdleTimeout           time.Duration `mapstructure:"idle-timeout"`
+	ShutdownGrace         time.Duration `mapstructure:"shutdown-grace"`
+	MetricsAddr           string        `mapstructure:"metrics-addr"`
+	CredentialsProvider   string        `mapstructure:"credentials-provider"`
+	AssumeRoleARN         string        `mapstructure:"assume-role-arn"`
+	AssumeRoleSessionName string        `mapstructure:"assume-role-session-name"`
+	AssumeRoleExternalID  string        `mapstructure:"assume-role-external-id"`
+	AssumeRoleDuration    time.Duration `mapstructure:"assume-role-duration"`
+	WebIdentityTokenFile  string        `mapstructure:"web-identity-token-file"`
+	WebIdentityRoleARN    string        `mapstructure:"web-identity-role-arn"`
 }
 
 var config configuration
 
-// NewSigningProxy proxies requests to AWS services which require URL signing using the provided credentials
-func NewSigningProxy(target *url.URL, creds *credentials.Credentials, region string) *httputil.ReverseProxy {
-	director := func(req *http.Request) {
-		// Rewrite request to desired server host
-		req.URL.Scheme = target.Scheme
-		req.URL.Host = target.Host
-		req.Host = target.Host
+// signingParams bundles the values needed to build an aws-sdk-go request.Request for signing,
+// so both the header-injecting proxy and the presigning proxy can share the same construction logic.
+type signingParams struct {
+	creds         *credentials.Credentials
+	region        string
+	serviceName   string
+	signingName   string
+	signingRegion string
+}
 
-		// To perform the signing, we leverage aws-sdk-go
-		// aws.request performs more functions than we need here
-		// we only populate enough of the fields to successfully
-		// sign the request
-		config := aws.NewConfig().WithCredentials(creds).WithRegion(region)
+// newAWSRequest builds a minimally-populated aws-sdk-go *request.Request for method/path/url, reading
+// and buffering body (if any) so it can be used for body digest calculation. This leverages aws-sdk-go
+// for signing purposes only; aws.request performs more functions than we need here, we only populate
+// enough of the fields to successfully sign the request.
+//
+// Referenced during the execution of awsReq.Sign()/Presign():
+//
+//	req.Config.Credentials
+//	req.Config.LogLevel.Value()
+//	req.Config.Logger
+//	req.ClientInfo.SigningRegion (will default to Config.Region)
+//	req.ClientInfo.SigningName (will default to ServiceName)
+//	req.ClientInfo.ServiceName
+//	req.HTTPRequest
+//	req.Time
+//	req.ExpireTime
+//	req.Body
+func newAWSRequest(p signingParams, method string, u *url.URL, body []byte) *request.Request {
+	config := aws.NewConfig().WithCredentials(p.creds).WithRegion(p.region)
 
-		clientInfo := metadata.ClientInfo{
-			ServiceName: "es",
-		}
+	clientInfo := metadata.ClientInfo{
+		ServiceName:   p.serviceName,
+		SigningName:   p.signingName,
+		SigningRegion: p.signingRegion,
+	}
 
-		operation := &request.Operation{
-			Name:       "",
-			HTTPMethod: req.Method,
-			HTTPPath:   req.URL.Path,
-		}
+	operation := &request.Operation{
+		Name:       "",
+		HTTPMethod: method,
+		HTTPPath:   u.Path,
+	}
 
-		handlers := request.Handlers{}
-		handlers.Sign.PushBack(v4.SignSDKRequest)
-
-		// Do we need to use request.New ? Or can we create a raw Request struct and
-		//  jus swap out the HTTPRequest with our own existing one?
-		awsReq := request.New(*config, clientInfo, handlers, nil, operation, nil, nil)
-		// Referenced during the execution of awsReq.Sign():
-		//  req.Config.Credentials
-		//  req.Config.LogLevel.Value()
-		//  req.Config.Logger
-		//  req.ClientInfo.SigningRegion (will default to Config.Region)
-		//  req.ClientInfo.SigningName (will default to ServiceName)
-		//  req.ClientInfo.ServiceName
-		//  req.HTTPRequest
-		//  req.Time
-		//  req.ExpireTime
-		//  req.Body
-
-		// Set the body in the awsReq for calculation of body Digest
-		// iotuil.ReadAll reads the Body from the stream so it can be copied into awsReq
-		// This drains the body from the original (proxied) request.
-		// To fix, we replace req.Body with a copy (NopCloser provides io.ReadCloser interface)
-		if req.Body != nil {
-			buf, err := ioutil.ReadAll(req.Body)
-			if err != nil {
-				log.Printf("error reading request body: %v\n", err)
-			}
-			req.Body = ioutil.NopCloser(bytes.NewBuffer(buf))
+	handlers := request.Handlers{}
+	handlers.Sign.PushBack(v4.SignSDKRequest)
 
-			awsReq.SetBufferBody(buf)
-		}
+	// Do we need to use request.New ? Or can we create a raw Request struct and
+	//  jus swap out the HTTPRequest with our own existing one?
+	awsReq := request.New(*config, clientInfo, handlers, nil, operation, nil, nil)
+
+	if body != nil {
+		awsReq.SetBufferBody(body)
+	}
 
-		// Use the updated req.URL for creating the signed request
-		// We pass the full URL object to include Host, Scheme, and any params
-		awsReq.HTTPRequest.URL = req.URL
-		// These are now set above via req, but it's imperative that this remains
-		//  correctly set before calling .Sign()
-		//awsReq.HTTPRequest.URL.Scheme = target.Scheme
-		//awsReq.HTTPRequest.URL.Host = target.Host
+	// Use the full URL object to include Host, Scheme, and any params
+	awsReq.HTTPRequest.URL = u
+
+	return awsReq
+}
+
+// readAndRestoreBody drains req.Body (if any) and replaces it with a copy, so the body can be used
+// for signing without preventing it from being proxied on to the upstream target.
+func readAndRestoreBody(req *http.Request) []byte {
+	if req.Body == nil {
+		return nil
+	}
+
+	buf, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Printf("error reading request body: %v\n", err)
+	}
+	req.Body = ioutil.NopCloser(bytes.NewBuffer(buf))
+
+	return buf
+}
+
+// NewSigningProxy proxies requests to AWS services which require URL signing using the provided credentials.
+// serviceName selects which AWS service to sign for (e.g. "es", "s3", "dynamodb"). signingName and
+// signingRegion override the values used in the SigV4 credential scope when a service's signing name/region
+// differs from its ClientInfo.ServiceName/region (mirroring how the AWS SDK derives these per-service).
+func NewSigningProxy(target *url.URL, creds *credentials.Credentials, region string, serviceName string, signingName string, signingRegion string, maxRetries int, upstreamTLSConfig *tls.Config) *httputil.ReverseProxy {
+	params := signingParams{
+		creds:         creds,
+		region:        region,
+		serviceName:   serviceName,
+		signingName:   signingName,
+		signingRegion: signingRegion,
+	}
+
+	director := func(req *http.Request) {
+		// Rewrite request to desired server host
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
+		req.Host = target.Host
+	}
+
+	// sign (re-)signs req for the given body. Signing happens in the Transport (see retryTransport)
+	// rather than here in the Director, because a SigV4 signature must be recomputed on every retry
+	// attempt: it embeds an X-Amz-Date that drifts as soon as time passes.
+	sign := func(req *http.Request, body []byte) error {
+		awsReq := newAWSRequest(params, req.Method, req.URL, body)
 
-		// Perform the signing, updating awsReq in place
 		if err := awsReq.Sign(); err != nil {
-			log.Printf("error signing: %v\n", err)
+			signingErrorsTotal.WithLabelValues(serviceName).Inc()
+			return err
 		}
 
-		// Write the Signed Headers into the Original Request
 		for k, v := range awsReq.HTTPRequest.Header {
 			req.Header[k] = v
 		}
+
+		return nil
 	}
 
 	// Convert config ints to duration
@@ -138,13 +231,53 @@ func NewSigningProxy(target *url.URL, creds *credentials.Credentials, region str
 		MaxIdleConns:        100,
 		IdleConnTimeout:     idleTimeout,
 		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     upstreamTLSConfig,
+	}
+	if err := http2.ConfigureTransport(transport); err != nil {
+		log.Printf("error enabling HTTP/2 for upstream transport: %v\n", err)
 	}
 
 	return &httputil.ReverseProxy{
 		Director:      director,
 		FlushInterval: flushInter,
-		Transport:     transport,
+		Transport: &retryTransport{
+			next:       transport,
+			sign:       sign,
+			maxRetries: maxRetries,
+		},
+	}
+}
+
+// NewPresigningProxy returns a handler which, instead of forwarding and signing the request itself,
+// responds with a 307 redirect to a presigned URL for target built via awsReq.Presign(expiry). This
+// lets callers that cannot sign requests themselves (e.g. browsers) be handed a short-lived URL instead.
+func NewPresigningProxy(target *url.URL, creds *credentials.Credentials, region string, serviceName string, signingName string, signingRegion string, expiry time.Duration) http.Handler {
+	params := signingParams{
+		creds:         creds,
+		region:        region,
+		serviceName:   serviceName,
+		signingName:   signingName,
+		signingRegion: signingRegion,
 	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		reqURL := *req.URL
+		reqURL.Scheme = target.Scheme
+		reqURL.Host = target.Host
+
+		buf := readAndRestoreBody(req)
+
+		awsReq := newAWSRequest(params, req.Method, &reqURL, buf)
+
+		presignedURL, err := awsReq.Presign(expiry)
+		if err != nil {
+			log.Printf("error presigning: %v\n", err)
+			http.Error(w, "error presigning request", http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, req, presignedURL, http.StatusTemporaryRedirect)
+	})
 }
 
 func main() {
@@ -155,6 +288,15 @@ func main() {
 
 	// Viper defaults
 	viper.SetDefault("region", "us-west-2")
+	viper.SetDefault("service", "es")
+	viper.SetDefault("presign-ttl", 5*time.Minute)
+	viper.SetDefault("max-retries", 3)
+	viper.SetDefault("tls-min-version", "1.2")
+	viper.SetDefault("read-header-timeout", 10*time.Second)
+	viper.SetDefault("idle-timeout", 360*time.Second)
+	viper.SetDefault("shutdown-grace", 30*time.Second)
+	viper.SetDefault("credentials-provider", "default")
+	viper.SetDefault("assume-role-session-name", "aws-signing-proxy")
 
 	// Bind ENV vars
 	viper.BindEnv("region", "AWS_REGION")
@@ -188,23 +330,119 @@ func main() {
 	listenAddress := config.ListenAddress
 	port := config.Port
 
-	// Get credentials:
-	// Environment variables > local aws config file > remote role provider
-	// https://github.com/aws/aws-sdk-go/blob/master/aws/defaults/defaults.go#L88
-	creds := defaults.CredChain(defaults.Config(), defaults.Handlers())
+	// Region order of precident:
+	// regionFlag > os.Getenv("AWS_REGION") > "us-west-2"
+	region := config.Region
+
+	// Get credentials from the configured provider (default, env, shared, ec2, ecs, web-identity,
+	// or assume-role). The returned *credentials.Credentials is shared across requests so its
+	// built-in expiry/refresh kicks in.
+	creds, err := buildCredentials(region, config)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	if _, err = creds.Get(); err != nil {
 		// We couldn't get any credentials
 		fmt.Println(err)
 		return
 	}
 
-	// Region order of precident:
-	// regionFlag > os.Getenv("AWS_REGION") > "us-west-2"
-	region := config.Region
+	// Build the upstream TLS config, used when dialing the proxy target.
+	upstreamTLSConfig, err := buildUpstreamTLSConfig(config.InsecureSkipVerify, config.UpstreamCA)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 
 	// Start the proxy server
-	proxy := NewSigningProxy(targetURL, creds, region)
+	var handler http.Handler
+	if config.Presign {
+		handler = NewPresigningProxy(targetURL, creds, region, config.Service, config.SigningName, config.SigningRegion, config.PresignTTL)
+	} else {
+		handler = NewSigningProxy(targetURL, creds, region, config.Service, config.SigningName, config.SigningRegion, config.MaxRetries, upstreamTLSConfig)
+	}
+	handler = instrumentHandler(config.Service, creds, handler)
+
+	if config.MetricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", promhttp.Handler())
+		go func() {
+			fmt.Printf("Serving metrics on %v\n", config.MetricsAddr)
+			if err := http.ListenAndServe(config.MetricsAddr, metricsMux); err != nil {
+				log.Printf("error serving metrics: %v\n", err)
+			}
+		}()
+	}
+
 	listenString := fmt.Sprintf("%s:%v", listenAddress, port)
-	fmt.Printf("Listening on %v\n", listenString)
-	http.ListenAndServe(listenString, proxy)
+	srv := &http.Server{
+		Addr:              listenString,
+		Handler:           handler,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+
+	if config.TLSClientCA != "" && config.TLSCert == "" {
+		fmt.Println("--tls-client-ca requires --tls-cert and --tls-key to also be set")
+		return
+	}
+
+	if config.TLSCert != "" && config.TLSKey == "" {
+		fmt.Println("--tls-cert requires --tls-key to also be set")
+		return
+	}
+
+	useTLS := config.TLSCert != ""
+	if useTLS {
+		minVersion, err := parseTLSVersion(config.TLSMinVersion)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		tlsConfig, err := buildServerTLSConfig(config.TLSClientCA, minVersion)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		srv.TLSConfig = tlsConfig
+	}
+
+	if err := http2.ConfigureServer(srv, &http2.Server{}); err != nil {
+		log.Printf("error enabling HTTP/2 for server: %v\n", err)
+	}
+
+	// Shut down gracefully on SIGINT/SIGTERM, giving in-flight requests config.ShutdownGrace to finish.
+	idleConnsClosed := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		<-sigs
+
+		ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownGrace)
+		defer cancel()
+
+		fmt.Println("Shutting down...")
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("error during shutdown: %v\n", err)
+		}
+		close(idleConnsClosed)
+	}()
+
+	var serveErr error
+	if useTLS {
+		fmt.Printf("Listening on %v (TLS)\n", listenString)
+		serveErr = srv.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+	} else {
+		fmt.Printf("Listening on %v\n", listenString)
+		serveErr = srv.ListenAndServe()
+	}
+	if serveErr != nil && serveErr != http.ErrServerClosed {
+		log.Fatal(serveErr)
+	}
+
+	<-idleConnsClosed
 }
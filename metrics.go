@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aws_signing_proxy_requests_total",
+		Help: "Total number of requests handled by the proxy, labeled by method, response status, and AWS service.",
+	}, []string{"method", "status", "service"})
+
+	upstreamLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "aws_signing_proxy_upstream_latency_seconds",
+		Help:    "Latency of proxied requests to the upstream target, labeled by AWS service.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"service"})
+
+	signingErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "aws_signing_proxy_signing_errors_total",
+		Help: "Total number of SigV4 signing errors, labeled by AWS service.",
+	}, []string{"service"})
+
+	inflightRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "aws_signing_proxy_inflight",
+		Help: "Number of requests currently being handled by the proxy.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, upstreamLatency, signingErrorsTotal, inflightRequests)
+}
+
+// statusRecorder wraps an http.ResponseWriter to capture the status code written to it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Hijack delegates to the embedded ResponseWriter's http.Hijacker, so upgraded connections
+// (WebSocket, etc.) proxied via httputil.ReverseProxy still work through the recorder.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying ResponseWriter does not support hijacking")
+	}
+
+	return hijacker.Hijack()
+}
+
+// truncatePrincipal returns a short, log-safe prefix of a SigV4 access key ID.
+func truncatePrincipal(accessKeyID string) string {
+	if len(accessKeyID) <= 4 {
+		return accessKeyID
+	}
+
+	return accessKeyID[:4] + "..."
+}
+
+// instrumentHandler wraps next with Prometheus counters/histograms and a structured JSON access log
+// entry per request, labeled by service. creds is used to attribute each log entry to the signing
+// principal (the access key ID driving SigV4), truncated for safe logging.
+func instrumentHandler(service string, creds *credentials.Credentials, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		inflightRequests.Inc()
+		defer inflightRequests.Dec()
+
+		requestID := newRequestID()
+		req.Header.Set("X-Request-Id", requestID)
+
+		principal := "-"
+		if v, err := creds.Get(); err == nil {
+			principal = truncatePrincipal(v.AccessKeyID)
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, req)
+
+		latency := time.Since(start)
+		upstreamLatency.WithLabelValues(service).Observe(latency.Seconds())
+		requestsTotal.WithLabelValues(req.Method, strconv.Itoa(rec.status), service).Inc()
+
+		logAccess(accessLogEntry{
+			RequestID: requestID,
+			Method:    req.Method,
+			Path:      req.URL.Path,
+			Status:    rec.status,
+			LatencyMS: float64(latency) / float64(time.Millisecond),
+			Principal: principal,
+		})
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// retryBaseDelay and retryMaxDelay bound the exponential backoff used between retry attempts.
+const (
+	retryBaseDelay = 1 * time.Second
+	retryMaxDelay  = 8 * time.Second
+)
+
+// signFunc (re-)signs req in place using body as the payload for the SigV4 body digest. It is called
+// before every attempt, including retries, since a SigV4 signature embeds an X-Amz-Date that drifts.
+type signFunc func(req *http.Request, body []byte) error
+
+// retryTransport wraps an http.RoundTripper, retrying idempotent requests that fail with a transport
+// error or a 5xx/429 response using exponential backoff with jitter, honoring Retry-After when present.
+// Because SigV4 signatures are time-bound, sign is invoked again before each attempt.
+type retryTransport struct {
+	next       http.RoundTripper
+	sign       signFunc
+	maxRetries int
+}
+
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
+
+func isRetryableResponse(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+}
+
+// retryAfterDelay honors a Retry-After header (seconds or HTTP-date) on 429/503 responses.
+func retryAfterDelay(resp *http.Response) time.Duration {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0
+	}
+
+	ra := resp.Header.Get("Retry-After")
+	if ra == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(ra); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+
+	if when, err := http.ParseTime(ra); err == nil {
+		return time.Until(when)
+	}
+
+	return 0
+}
+
+// backoffDelay computes the exponential-backoff-with-jitter delay for the given attempt (0-indexed):
+// capped = min(base*2^attempt, max); sleep = rand(capped) + capped.
+func backoffDelay(attempt int, base, max time.Duration) time.Duration {
+	capped := base * time.Duration(int64(1)<<uint(attempt))
+	if capped <= 0 || capped > max {
+		capped = max
+	}
+
+	return time.Duration(rand.Int63n(int64(capped)+1)) + capped
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var bodyBuf []byte
+	if req.Body != nil {
+		buf, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		bodyBuf = buf
+	}
+
+	retryable := isIdempotentMethod(req.Method)
+
+	var resp *http.Response
+	var err error
+	for attempt := 0; ; attempt++ {
+		if bodyBuf != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(bodyBuf))
+		}
+
+		if t.sign != nil {
+			if signErr := t.sign(req, bodyBuf); signErr != nil {
+				log.Printf("error signing request (attempt %d): %v\n", attempt, signErr)
+			}
+		}
+
+		resp, err = t.next.RoundTrip(req)
+
+		done := attempt >= t.maxRetries || !retryable
+		if !done {
+			if err == nil && !isRetryableResponse(resp) {
+				done = true
+			}
+		}
+		if done {
+			return resp, err
+		}
+
+		delay := backoffDelay(attempt, retryBaseDelay, retryMaxDelay)
+		if resp != nil {
+			if ra := retryAfterDelay(resp); ra > 0 {
+				delay = ra
+			}
+			resp.Body.Close()
+		}
+
+		log.Printf("retrying upstream request after %v (attempt %d/%d): method=%s err=%v\n", delay, attempt+1, t.maxRetries, req.Method, err)
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// tlsVersions maps the --tls-min-version flag values to their crypto/tls constants.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion resolves a --tls-min-version flag value (e.g. "1.2") to its crypto/tls constant.
+func parseTLSVersion(version string) (uint16, error) {
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("unsupported tls-min-version %q, expected one of 1.0, 1.1, 1.2, 1.3", version)
+	}
+
+	return v, nil
+}
+
+// loadCertPool reads a PEM file of one or more certificates into an *x509.CertPool.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+
+	pool := x509.NewCertPool()
+	if ok := pool.AppendCertsFromPEM(pem); !ok {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	return pool, nil
+}
+
+// buildServerTLSConfig builds the *tls.Config for the listener. When clientCAFile is set, client
+// certificates are required and verified against it (mTLS); otherwise the server accepts plain TLS.
+func buildServerTLSConfig(clientCAFile string, minVersion uint16) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: minVersion,
+	}
+
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// buildUpstreamTLSConfig builds the *tls.Config used by the outbound Transport when talking to the
+// proxy target, e.g. to trust a private CA fronting a VPC endpoint.
+func buildUpstreamTLSConfig(insecureSkipVerify bool, upstreamCAFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+
+	if upstreamCAFile != "" {
+		pool, err := loadCertPool(upstreamCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}